@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
-	"github.com/Azure/azure-sdk-for-go/arm/storage"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
@@ -15,18 +20,25 @@ import (
 )
 
 var (
-	groupName              = "your-azure-sample-group"
-	westus                 = "westus"
-	vNetName               = "vNet"
-	subnetName             = "subnet"
-	ipName                 = "pip"
-	frontEndIPConfigName   = "fip"
-	backEndAddressPoolName = "backEndPool"
-	probeName              = "probe"
-	loadBalancerName       = "lb"
-	storageAccountName     = "golangrocksonazure"
-	vmName1                = "Web1"
-	vmName2                = "Web2"
+	groupName            string
+	location             string
+	cloudName            string
+	vNetName             string
+	subnetName           string
+	ipName               string
+	frontEndIPConfigName = "fip"
+	loadBalancerName     string
+	vmNamePrefix         string
+	vmCount              int
+	vmSize               string
+
+	// resourceGroupCreated, finished and keepOnFailure let onErrorFail
+	// decide whether to best-effort delete the resource group before
+	// exiting: os.Exit never runs deferred functions, so that cleanup
+	// can't live in a defer in main if it's meant to run on this path.
+	resourceGroupCreated bool
+	finished             bool
+	keepOnFailure        bool
 
 	groupClient     resources.GroupsClient
 	lbClient        network.LoadBalancersClient
@@ -35,44 +47,209 @@ var (
 	pipClient       network.PublicIPAddressesClient
 	interfaceClient network.InterfacesClient
 	availSetClient  compute.AvailabilitySetsClient
-	accountClient   storage.AccountsClient
 	vmClient        compute.VirtualMachinesClient
 )
 
-var (
-	subscriptionID string
-	authorizer     *autorest.BearerAuthorizer
-)
+// config holds all the values that vary between runs of this sample, so that
+// it can be pointed at different subscriptions, regions and Azure clouds
+// instead of always creating "your-azure-sample-group" in westus.
+type config struct {
+	GroupName              string    `json:"groupName"`
+	Location               string    `json:"location"`
+	CloudName              string    `json:"cloudName"`
+	VNetName               string    `json:"vNetName"`
+	SubnetName             string    `json:"subnetName"`
+	IPName                 string    `json:"ipName"`
+	LoadBalancerName       string    `json:"loadBalancerName"`
+	VMNamePrefix           string    `json:"vmNamePrefix"`
+	VMCount                int       `json:"vmCount"`
+	VMSize                 string    `json:"vmSize"`
+	AdminUsername          string    `json:"adminUsername"`
+	AdminPassword          string    `json:"adminPassword"`
+	SSHPublicKeyPath       string    `json:"sshPublicKeyPath"`
+	DataDiskSizeGB         int       `json:"dataDiskSizeGB"`
+	KeepOnFailure          bool      `json:"keepOnFailure"`
+	LoadBalancerSku        string    `json:"loadBalancerSku"`
+	HAPorts                bool      `json:"haPorts"`
+	EnableOutboundRule     bool      `json:"enableOutboundRule"`
+	AllocatedOutboundPorts int       `json:"allocatedOutboundPorts"`
+	EnableRDP              bool      `json:"enableRDP"`
+	Services               []Service `json:"services"`
+}
 
-func init() {
-	authorizer, err := utils.GetAuthorizer(azure.PublicCloud)
-	onErrorFail(err, "GetAuthorizer failed")
+// ProbeSpec describes a service's health probe.
+type ProbeSpec struct {
+	Path               string `json:"path"`
+	IntervalSeconds    int32  `json:"intervalSeconds"`
+	UnhealthyThreshold int32  `json:"unhealthyThreshold"`
+}
+
+// Service describes one load-balanced tier: a frontend/backend port pair,
+// transport protocol and health probe. buildLoadBalancer turns a slice of
+// these into one rule and probe per service, all on a single shared backend
+// pool.
+type Service struct {
+	Name         string                    `json:"name"`
+	Protocol     network.TransportProtocol `json:"protocol"`
+	FrontendPort int32                     `json:"frontendPort"`
+	BackendPort  int32                     `json:"backendPort"`
+	Probe        ProbeSpec                 `json:"probe"`
+}
+
+// authConfig describes how a VM authenticates: either an admin password, or
+// an SSH public key (which also disables password authentication).
+type authConfig struct {
+	AdminUsername    string
+	AdminPassword    string
+	SSHPublicKeyPath string
+}
+
+// defaultConfig returns the values this sample used to hard-code as package
+// variables.
+func defaultConfig() config {
+	return config{
+		GroupName:              "your-azure-sample-group",
+		Location:               "westus",
+		CloudName:              azure.PublicCloud.Name,
+		VNetName:               "vNet",
+		SubnetName:             "subnet",
+		IPName:                 "pip",
+		LoadBalancerName:       "lb",
+		VMNamePrefix:           "Web",
+		VMCount:                2,
+		VMSize:                 string(compute.StandardDS1),
+		AdminUsername:          "notAdmin",
+		LoadBalancerSku:        string(network.LoadBalancerSkuNameBasic),
+		AllocatedOutboundPorts: 1024,
+		Services:               defaultServices(),
+	}
+}
 
-	subscriptionID = utils.GetEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
-	createClients(subscriptionID, authorizer)
+// defaultServices returns the single HTTP service this sample load-balanced
+// before services became configurable.
+func defaultServices() []Service {
+	return []Service{
+		{
+			Name:         "http",
+			Protocol:     network.TransportProtocolTCP,
+			FrontendPort: 80,
+			BackendPort:  80,
+			Probe: ProbeSpec{
+				Path:               "healthprobe.aspx",
+				IntervalSeconds:    15,
+				UnhealthyThreshold: 4,
+			},
+		},
+	}
+}
+
+// loadConfigFile overlays cfg with the JSON-encoded config found at path.
+func loadConfigFile(cfg *config, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %s", err)
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+// parseFlags parses args into cfg. A -config file, if given, is applied
+// first; any flag the caller set explicitly on the command line always wins
+// over the value loaded from the file.
+func parseFlags(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("azure-sample", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to a JSON config file with sample settings")
+	fs.StringVar(&cfg.GroupName, "group", cfg.GroupName, "resource group name")
+	fs.StringVar(&cfg.Location, "location", cfg.Location, "Azure region, e.g. westus")
+	fs.StringVar(&cfg.CloudName, "cloud", cfg.CloudName, "Azure cloud: AzurePublicCloud, AzureChinaCloud, AzureGermanCloud or AzureUSGovernmentCloud")
+	fs.StringVar(&cfg.VNetName, "vnet", cfg.VNetName, "virtual network name")
+	fs.StringVar(&cfg.SubnetName, "subnet", cfg.SubnetName, "subnet name")
+	fs.StringVar(&cfg.IPName, "ip", cfg.IPName, "public IP name")
+	fs.StringVar(&cfg.LoadBalancerName, "lb", cfg.LoadBalancerName, "load balancer name")
+	fs.StringVar(&cfg.VMNamePrefix, "vm-prefix", cfg.VMNamePrefix, "prefix used to name the VMs")
+	fs.IntVar(&cfg.VMCount, "vm-count", cfg.VMCount, "number of VMs to create")
+	fs.StringVar(&cfg.VMSize, "vm-size", cfg.VMSize, "VM size, e.g. Standard_DS1_v2")
+	fs.StringVar(&cfg.AdminUsername, "admin-username", cfg.AdminUsername, "admin username for the VMs")
+	fs.StringVar(&cfg.AdminPassword, "admin-password", cfg.AdminPassword, "admin password for the VMs (ignored if -ssh-public-key is set)")
+	fs.StringVar(&cfg.SSHPublicKeyPath, "ssh-public-key", cfg.SSHPublicKeyPath, "path to an SSH public key to authorize instead of password auth")
+	fs.IntVar(&cfg.DataDiskSizeGB, "data-disk-size-gb", cfg.DataDiskSizeGB, "size in GiB of an empty managed data disk to attach to each VM (0 to skip)")
+	fs.BoolVar(&cfg.KeepOnFailure, "keep-on-failure", cfg.KeepOnFailure, "do not delete the resource group if the run fails or is interrupted")
+	fs.StringVar(&cfg.LoadBalancerSku, "lb-sku", cfg.LoadBalancerSku, "load balancer SKU: Basic or Standard")
+	fs.BoolVar(&cfg.HAPorts, "ha-ports", cfg.HAPorts, "use a single HA Ports rule (all ports/protocols) instead of the per-service rules; requires a Standard SKU load balancer")
+	fs.BoolVar(&cfg.EnableOutboundRule, "enable-outbound-rule", cfg.EnableOutboundRule, "add an outbound SNAT rule for the backend pool; requires a Standard SKU load balancer")
+	fs.IntVar(&cfg.AllocatedOutboundPorts, "allocated-outbound-ports", cfg.AllocatedOutboundPorts, "SNAT ports allocated per VM by the outbound rule")
+	fs.BoolVar(&cfg.EnableRDP, "enable-rdp", cfg.EnableRDP, "also create an RDP (3389) NAT rule for each VM")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if *configPath != "" {
+		if err := loadConfigFile(cfg, *configPath); err != nil {
+			return err
+		}
+		for name, value := range explicit {
+			if err := fs.Set(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.SSHPublicKeyPath == "" && cfg.AdminPassword == "" {
+		return fmt.Errorf("either -ssh-public-key or -admin-password (or their config file equivalents) must be set; this sample no longer ships an insecure default password")
+	}
+
+	return nil
 }
 
 func main() {
+	cfg := defaultConfig()
+	if err := parseFlags(&cfg, os.Args[1:]); err != nil {
+		onErrorFail(err, "parseFlags failed")
+	}
+
+	groupName = cfg.GroupName
+	location = cfg.Location
+	cloudName = cfg.CloudName
+	vNetName = cfg.VNetName
+	subnetName = cfg.SubnetName
+	ipName = cfg.IPName
+	loadBalancerName = cfg.LoadBalancerName
+	vmNamePrefix = cfg.VMNamePrefix
+	vmCount = cfg.VMCount
+	vmSize = cfg.VMSize
+	keepOnFailure = cfg.KeepOnFailure
+	auth := authConfig{
+		AdminUsername:    cfg.AdminUsername,
+		AdminPassword:    cfg.AdminPassword,
+		SSHPublicKeyPath: cfg.SSHPublicKeyPath,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	env, err := azure.EnvironmentFromName(cloudName)
+	onErrorFail(err, "EnvironmentFromName failed")
+
+	authorizer, err := utils.GetAuthorizer(env)
+	onErrorFail(err, "GetAuthorizer failed")
+
+	subscriptionID := utils.GetEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
+	onErrorFail(createClients(ctx, subscriptionID, authorizer), "createClients failed")
+
 	fmt.Println("Creating resource group")
 	resourceGroupParameters := resources.Group{
-		Location: &westus}
-	_, err := groupClient.CreateOrUpdate(groupName, resourceGroupParameters)
+		Location: &location}
+	_, err = groupClient.CreateOrUpdate(groupName, resourceGroupParameters)
 	onErrorFail(err, "CreateOrUpdate failed")
-
-	fmt.Println("Starting to create storage account...")
-	accountParameters := storage.AccountCreateParameters{
-		Sku: &storage.Sku{
-			Name: storage.StandardLRS,
-		},
-		Kind:     storage.Storage,
-		Location: &westus,
-		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{},
-	}
-	_, errStorageAccount := accountClient.Create(groupName, storageAccountName, accountParameters, nil)
+	resourceGroupCreated = true
 
 	fmt.Println("Starting to create public IP address...")
 	pip := network.PublicIPAddress{
-		Location: &westus,
+		Location: &location,
 		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
 			PublicIPAllocationMethod: network.Static,
 			DNSSettings: &network.PublicIPAddressDNSSettings{
@@ -81,75 +258,20 @@ func main() {
 		},
 	}
 	pipChan, errPIP := pipClient.CreateOrUpdate(groupName, ipName, pip, nil)
-	onErrorFail(<-errPIP, "CreateOrUpdate Public IP failed")
+	onErrorFail(waitErr(ctx, errPIP), "CreateOrUpdate Public IP failed")
 	fmt.Println("... public IP created")
 	pip = <-pipChan
 
 	fmt.Println("Starting to create load balancer...")
-	lb := network.LoadBalancer{
-		Location: &westus,
-		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{
-			FrontendIPConfigurations: &[]network.FrontendIPConfiguration{
-				{
-					Name: &frontEndIPConfigName,
-					FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
-						PrivateIPAllocationMethod: network.Dynamic,
-						PublicIPAddress:           &pip,
-					},
-				},
-			},
-			BackendAddressPools: &[]network.BackendAddressPool{
-				{
-					Name: &backEndAddressPoolName},
-			},
-			Probes: &[]network.Probe{
-				{
-					Name: &probeName,
-					ProbePropertiesFormat: &network.ProbePropertiesFormat{
-						Protocol:          network.ProbeProtocolHTTP,
-						Port:              to.Int32Ptr(80),
-						IntervalInSeconds: to.Int32Ptr(15),
-						NumberOfProbes:    to.Int32Ptr(4),
-						RequestPath:       to.StringPtr("healthprobe.aspx"),
-					},
-				},
-			},
-			LoadBalancingRules: &[]network.LoadBalancingRule{
-				{
-					Name: to.StringPtr("lbRule"),
-					LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
-						Protocol:             network.TransportProtocolTCP,
-						FrontendPort:         to.Int32Ptr(80),
-						BackendPort:          to.Int32Ptr(80),
-						IdleTimeoutInMinutes: to.Int32Ptr(4),
-						EnableFloatingIP:     to.BoolPtr(false),
-						LoadDistribution:     network.Default,
-						FrontendIPConfiguration: &network.SubResource{
-							ID: to.StringPtr(buildID(subscriptionID, "frontendIPConfigurations", frontEndIPConfigName)),
-						},
-						BackendAddressPool: &network.SubResource{
-							ID: to.StringPtr(buildID(subscriptionID, "backendAddressPools", backEndAddressPoolName)),
-						},
-						Probe: &network.SubResource{
-							ID: to.StringPtr(buildID(subscriptionID, "probes", probeName)),
-						},
-					},
-				},
-			},
-			InboundNatRules: &[]network.InboundNatRule{
-				buildNATrule("natRule1", subscriptionID, 21),
-				buildNATrule("natRule2", subscriptionID, 23),
-			},
-		},
-	}
+	lb := buildLoadBalancer(cfg, pip, subscriptionID, cfg.Services, vmCount)
 	lbChan, errLB := lbClient.CreateOrUpdate(groupName, loadBalancerName, lb, nil)
-	onErrorFail(<-errLB, "CreateOrUpdate Load Balancer failed")
+	onErrorFail(waitErr(ctx, errLB), "CreateOrUpdate Load Balancer failed")
 	fmt.Println("... load balancer created")
 	lb = <-lbChan
 
 	fmt.Println("Starting to create virtual network...")
 	vNetParameters := network.VirtualNetwork{
-		Location: &westus,
+		Location: &location,
 		VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
 			AddressSpace: &network.AddressSpace{
 				AddressPrefixes: &[]string{"10.0.0.0/16"},
@@ -157,7 +279,7 @@ func main() {
 		},
 	}
 	_, errVnet := vNetClient.CreateOrUpdate(groupName, vNetName, vNetParameters, nil)
-	onErrorFail(<-errVnet, "CreateOrUpdate Virtual Network failed")
+	onErrorFail(waitErr(ctx, errVnet), "CreateOrUpdate Virtual Network failed")
 	fmt.Println("... virtual network created")
 
 	fmt.Println("Starting to create subnet...")
@@ -167,7 +289,7 @@ func main() {
 		},
 	}
 	_, errSubnet := subnetClient.CreateOrUpdate(groupName, vNetName, subnetName, subnet, nil)
-	onErrorFail(<-errSubnet, "CreateOrUpdate Subnet failed")
+	onErrorFail(waitErr(ctx, errSubnet), "CreateOrUpdate Subnet failed")
 	fmt.Println("... subnet created")
 
 	subnet, err = subnetClient.Get(groupName, vNetName, subnetName, "")
@@ -175,20 +297,20 @@ func main() {
 
 	fmt.Println("Creating availability set")
 	availSet := compute.AvailabilitySet{
-		Location: &westus}
+		Location: &location}
 	availSet, err = availSetClient.CreateOrUpdate(groupName, "availSet", availSet)
 	onErrorFail(err, "CreateOrUpdate failed")
 
-	onErrorFail(<-errStorageAccount, "Create Storage Account failed")
-	fmt.Println("... storage account created")
-
-	fmt.Printf("Creating virtual machine '%s'\n", vmName1)
-	err = createVM(vmName1, subnet.ID, availSet.ID, pip.IPAddress, lb, 0)
-	onErrorFail(err, "createVM failed")
-
-	fmt.Printf("Creating virtual machine '%s'\n", vmName2)
-	err = createVM(vmName2, subnet.ID, availSet.ID, pip.IPAddress, lb, 1)
-	onErrorFail(err, "createVM failed")
+	for i := 0; i < vmCount; i++ {
+		vmName := fmt.Sprintf("%s%d", vmNamePrefix, i+1)
+		fmt.Printf("Creating virtual machine '%s'\n", vmName)
+		rdpNatRule := -1
+		if cfg.EnableRDP {
+			rdpNatRule = vmCount + i
+		}
+		err = createVM(ctx, vmName, subnet.ID, availSet.ID, pip.IPAddress, lb, i, rdpNatRule, auth, int32(cfg.DataDiskSizeGB))
+		onErrorFail(err, "createVM failed")
+	}
 
 	fmt.Println("Listing resources in resource group")
 	list, err := groupClient.ListResources(groupName, "", "", nil)
@@ -208,14 +330,31 @@ func main() {
 
 	fmt.Println("Starting to delete the resource group...")
 	_, errGroup := groupClient.Delete(groupName, nil)
-	onErrorFail(<-errGroup, "Delete resource group failed")
+	onErrorFail(waitErr(ctx, errGroup), "Delete resource group failed")
 	fmt.Println("... resource group deleted")
+	finished = true
 
 	fmt.Println("Done!")
 }
 
+// waitErr blocks until err is delivered on ch or ctx is cancelled, whichever
+// comes first, so a Ctrl-C can interrupt a pending CreateOrUpdate and let the
+// caller's cleanup run instead of hanging until the API call returns.
+func waitErr(ctx context.Context, ch <-chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // createClients initializes and adds token to all needed clients in the sample.
-func createClients(subscriptionID string, authorizer *autorest.BearerAuthorizer) {
+func createClients(ctx context.Context, subscriptionID string, authorizer *autorest.BearerAuthorizer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	sampleUA := fmt.Sprintf("sample/0006/%s", utils.GetCommit())
 
 	groupClient = resources.NewGroupsClient(subscriptionID)
@@ -246,23 +385,159 @@ func createClients(subscriptionID string, authorizer *autorest.BearerAuthorizer)
 	availSetClient.Authorizer = authorizer
 	availSetClient.Client.AddToUserAgent(sampleUA)
 
-	accountClient = storage.NewAccountsClient(subscriptionID)
-	accountClient.Authorizer = authorizer
-	accountClient.Client.AddToUserAgent(sampleUA)
-
 	vmClient = compute.NewVirtualMachinesClient(subscriptionID)
 	vmClient.Authorizer = authorizer
 	vmClient.Client.AddToUserAgent(sampleUA)
+
+	return nil
+}
+
+// getRuleName deterministically names the load-balancing rule or probe for
+// service's given port, so each (service, port) pair always maps to the same
+// Azure resource name across runs.
+func getRuleName(service Service, port int32) string {
+	return fmt.Sprintf("%s-%d", service.Name, port)
+}
+
+// buildLoadBalancer assembles the full LoadBalancer resource: a single
+// backend pool, one load-balancing rule and probe per entry in services, SSH (and
+// optionally RDP) NAT rules for vmCount VMs, and the outbound rule / HA
+// Ports / SKU behavior selected by cfg. HA Ports and outbound rules require
+// a Standard SKU load balancer.
+func buildLoadBalancer(cfg config, pip network.PublicIPAddress, subscriptionID string, services []Service, vmCount int) network.LoadBalancer {
+	// All VMs join a single backend pool, and every service gets its own
+	// rule/probe on that same pool -- the Kubernetes cloud-provider pattern
+	// of one node pool with multiple per-port rules, rather than a pool per
+	// service (which would leave every service past the first with no
+	// healthy targets, since VMs only ever join one pool).
+	const backendPoolName = "backendPool"
+	backendPools := []network.BackendAddressPool{{Name: to.StringPtr(backendPoolName)}}
+
+	var probes []network.Probe
+	var rules []network.LoadBalancingRule
+	for _, service := range services {
+		probeName := getRuleName(service, service.BackendPort)
+		probes = append(probes, network.Probe{
+			Name: to.StringPtr(probeName),
+			ProbePropertiesFormat: &network.ProbePropertiesFormat{
+				Protocol:          network.ProbeProtocolHTTP,
+				Port:              to.Int32Ptr(service.BackendPort),
+				IntervalInSeconds: to.Int32Ptr(service.Probe.IntervalSeconds),
+				NumberOfProbes:    to.Int32Ptr(service.Probe.UnhealthyThreshold),
+				RequestPath:       to.StringPtr(service.Probe.Path),
+			},
+		})
+
+		rules = append(rules, network.LoadBalancingRule{
+			Name: to.StringPtr(getRuleName(service, service.FrontendPort)),
+			LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+				Protocol:             service.Protocol,
+				FrontendPort:         to.Int32Ptr(service.FrontendPort),
+				BackendPort:          to.Int32Ptr(service.BackendPort),
+				IdleTimeoutInMinutes: to.Int32Ptr(4),
+				EnableFloatingIP:     to.BoolPtr(false),
+				LoadDistribution:     network.Default,
+				FrontendIPConfiguration: &network.SubResource{
+					ID: to.StringPtr(buildID(subscriptionID, "frontendIPConfigurations", frontEndIPConfigName)),
+				},
+				BackendAddressPool: &network.SubResource{
+					ID: to.StringPtr(buildID(subscriptionID, "backendAddressPools", backendPoolName)),
+				},
+				Probe: &network.SubResource{
+					ID: to.StringPtr(buildID(subscriptionID, "probes", probeName)),
+				},
+			},
+		})
+	}
+
+	if cfg.HAPorts {
+		rules = []network.LoadBalancingRule{
+			{
+				Name: to.StringPtr("haPortsRule"),
+				LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+					Protocol:     network.TransportProtocolAll,
+					FrontendPort: to.Int32Ptr(0),
+					BackendPort:  to.Int32Ptr(0),
+					FrontendIPConfiguration: &network.SubResource{
+						ID: to.StringPtr(buildID(subscriptionID, "frontendIPConfigurations", frontEndIPConfigName)),
+					},
+					BackendAddressPool: &network.SubResource{
+						ID: to.StringPtr(buildID(subscriptionID, "backendAddressPools", backendPoolName)),
+					},
+				},
+			},
+		}
+	}
+
+	natRules := make([]network.InboundNatRule, 0, vmCount*2)
+	for i := 0; i < vmCount; i++ {
+		natRules = append(natRules, buildNATrule(fmt.Sprintf("sshRule%d", i+1), subscriptionID, int32(50000+i), 22))
+	}
+	if cfg.EnableRDP {
+		for i := 0; i < vmCount; i++ {
+			natRules = append(natRules, buildNATrule(fmt.Sprintf("rdpRule%d", i+1), subscriptionID, int32(51000+i), 3389))
+		}
+	}
+
+	lb := network.LoadBalancer{
+		Location: &location,
+		Sku: &network.LoadBalancerSku{
+			Name: network.LoadBalancerSkuName(cfg.LoadBalancerSku),
+		},
+		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{
+			FrontendIPConfigurations: &[]network.FrontendIPConfiguration{
+				{
+					Name: &frontEndIPConfigName,
+					FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
+						PrivateIPAllocationMethod: network.Dynamic,
+						PublicIPAddress:           &pip,
+					},
+				},
+			},
+			BackendAddressPools: &backendPools,
+			Probes:              &probes,
+			LoadBalancingRules:  &rules,
+			InboundNatRules:     &natRules,
+		},
+	}
+
+	if cfg.EnableOutboundRule {
+		outboundRules := []network.OutboundRule{buildOutboundRule(subscriptionID, cfg.AllocatedOutboundPorts, backendPoolName)}
+		lb.LoadBalancerPropertiesFormat.OutboundRules = &outboundRules
+	}
+
+	return lb
+}
+
+// buildOutboundRule returns an OutboundRule that gives every VM behind
+// backendPoolName allocatedOutboundPorts SNAT ports for outbound
+// connectivity. Outbound rules require a Standard SKU load balancer.
+func buildOutboundRule(subscriptionID string, allocatedOutboundPorts int, backendPoolName string) network.OutboundRule {
+	return network.OutboundRule{
+		Name: to.StringPtr("outboundRule"),
+		OutboundRulePropertiesFormat: &network.OutboundRulePropertiesFormat{
+			Protocol:               network.TransportProtocolAll,
+			AllocatedOutboundPorts: to.Int32Ptr(int32(allocatedOutboundPorts)),
+			BackendAddressPool: &network.SubResource{
+				ID: to.StringPtr(buildID(subscriptionID, "backendAddressPools", backendPoolName)),
+			},
+			FrontendIPConfigurations: &[]network.SubResource{
+				{
+					ID: to.StringPtr(buildID(subscriptionID, "frontendIPConfigurations", frontEndIPConfigName)),
+				},
+			},
+		},
+	}
 }
 
 // buildNATrule returns a network.InboundNatRule struct with all needed fields included.
-func buildNATrule(natRuleName, subscriptionID string, frontEndPort int32) network.InboundNatRule {
+func buildNATrule(natRuleName, subscriptionID string, frontEndPort, backendPort int32) network.InboundNatRule {
 	return network.InboundNatRule{
 		Name: &natRuleName,
 		InboundNatRulePropertiesFormat: &network.InboundNatRulePropertiesFormat{
 			Protocol:             network.TransportProtocolTCP,
 			FrontendPort:         to.Int32Ptr(frontEndPort),
-			BackendPort:          to.Int32Ptr(22),
+			BackendPort:          to.Int32Ptr(backendPort),
 			EnableFloatingIP:     to.BoolPtr(false),
 			IdleTimeoutInMinutes: to.Int32Ptr(4),
 			FrontendIPConfiguration: &network.SubResource{
@@ -282,10 +557,19 @@ func buildID(subscriptionID, subType, subTypeName string) string {
 		subTypeName)
 }
 
-// buildNICparams returns a network.Interface struct with all needed fields included.
-func buildNICparams(subnetID *string, lb network.LoadBalancer, natRule int) network.Interface {
+// buildNICparams returns a network.Interface struct with all needed fields
+// included. sshNatRule is always attached; rdpNatRule is also attached if
+// >= 0, and left out otherwise (the -enable-rdp flag is off).
+func buildNICparams(subnetID *string, lb network.LoadBalancer, sshNatRule, rdpNatRule int) network.Interface {
+	natRules := []network.InboundNatRule{
+		{ID: (*lb.InboundNatRules)[sshNatRule].ID},
+	}
+	if rdpNatRule >= 0 {
+		natRules = append(natRules, network.InboundNatRule{ID: (*lb.InboundNatRules)[rdpNatRule].ID})
+	}
+
 	return network.Interface{
-		Location: &westus,
+		Location: &location,
 		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
 			IPConfigurations: &[]network.InterfaceIPConfiguration{
 				{
@@ -299,11 +583,7 @@ func buildNICparams(subnetID *string, lb network.LoadBalancer, natRule int) netw
 								ID: (*lb.BackendAddressPools)[0].ID,
 							},
 						},
-						LoadBalancerInboundNatRules: &[]network.InboundNatRule{
-							{
-								ID: (*lb.InboundNatRules)[natRule].ID,
-							},
-						},
+						LoadBalancerInboundNatRules: &natRules,
 					},
 				},
 			},
@@ -311,14 +591,15 @@ func buildNICparams(subnetID *string, lb network.LoadBalancer, natRule int) netw
 	}
 }
 
-// createVM creates a VM, including its NIC.
-func createVM(vmName string, subnetID, availSetID, ipAddress *string, lb network.LoadBalancer, natRule int) error {
+// createVM creates a VM, including its NIC. rdpNatRule is the index into
+// lb.InboundNatRules for this VM's RDP rule, or -1 if -enable-rdp wasn't set.
+func createVM(ctx context.Context, vmName string, subnetID, availSetID, ipAddress *string, lb network.LoadBalancer, natRule, rdpNatRule int, auth authConfig, dataDiskSizeGB int32) error {
 	nicName := fmt.Sprintf("nic-%s", vmName)
 
 	fmt.Printf("Starting to create NIC for '%s' machine\n", vmName)
-	nic := buildNICparams(subnetID, lb, natRule)
+	nic := buildNICparams(subnetID, lb, natRule, rdpNatRule)
 	nicChan, errNIC := interfaceClient.CreateOrUpdate(groupName, nicName, nic, nil)
-	err := <-errNIC
+	err := waitErr(ctx, errNIC)
 	if err != nil {
 		fmt.Println("Create NIC failed")
 		return err
@@ -327,37 +608,97 @@ func createVM(vmName string, subnetID, availSetID, ipAddress *string, lb network
 	nic = <-nicChan
 
 	fmt.Printf("Starting to create machine '%s'\n", vmName)
-	vm := buildVMparams(vmName, nic.ID, availSetID)
+	vm, err := buildVMparams(vmName, nic.ID, availSetID, auth)
+	if err != nil {
+		fmt.Println("buildVMparams failed")
+		return err
+	}
+
+	if dataDiskSizeGB > 0 {
+		vm = createDataDisk(vm, dataDiskSizeGB, nextAvailableLUN(vm))
+	}
+
 	_, errVM := vmClient.CreateOrUpdate(groupName, vmName, vm, nil)
-	err = <-errVM
+	err = waitErr(ctx, errVM)
 	if err != nil {
 		fmt.Println("Create VM failed")
 		return err
 	}
 	fmt.Println("VM created")
 
-	fmt.Printf("Now you can connect to '%s' via 'ssh %s@%s -p %v' with password '%s'\n",
-		vmName,
-		*vm.OsProfile.AdminUsername,
-		*ipAddress,
-		*(*lb.InboundNatRules)[natRule].FrontendPort,
-		*vm.OsProfile.AdminPassword)
+	if auth.SSHPublicKeyPath != "" {
+		fmt.Printf("Now you can connect to '%s' via 'ssh %s@%s -p %v' with your SSH key\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*ipAddress,
+			*(*lb.InboundNatRules)[natRule].FrontendPort)
+	} else {
+		fmt.Printf("Now you can connect to '%s' via 'ssh %s@%s -p %v' with password '%s'\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*ipAddress,
+			*(*lb.InboundNatRules)[natRule].FrontendPort,
+			*vm.OsProfile.AdminPassword)
+	}
+
+	if rdpNatRule >= 0 {
+		fmt.Printf("RDP available on '%s' via %s:%v\n",
+			vmName,
+			*ipAddress,
+			*(*lb.InboundNatRules)[rdpNatRule].FrontendPort)
+	}
 
 	return nil
 }
 
+// newOSProfile builds the OSProfile for vmName from auth, switching between
+// password and SSH-key authentication. A future Windows profile (WinRM
+// listeners, AdminPassword randomization) can be added by branching on an
+// OS-type parameter here.
+func newOSProfile(vmName string, auth authConfig) (*compute.OSProfile, error) {
+	profile := &compute.OSProfile{
+		ComputerName:  &vmName,
+		AdminUsername: to.StringPtr(auth.AdminUsername),
+	}
+
+	if auth.SSHPublicKeyPath == "" {
+		profile.AdminPassword = to.StringPtr(auth.AdminPassword)
+		return profile, nil
+	}
+
+	keyData, err := ioutil.ReadFile(auth.SSHPublicKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading SSH public key: %s", err)
+	}
+
+	profile.LinuxConfiguration = &compute.LinuxConfiguration{
+		DisablePasswordAuthentication: to.BoolPtr(true),
+		SSH: &compute.SSHConfiguration{
+			PublicKeys: &[]compute.SSHPublicKey{
+				{
+					Path:    to.StringPtr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", auth.AdminUsername)),
+					KeyData: to.StringPtr(string(keyData)),
+				},
+			},
+		},
+	}
+
+	return profile, nil
+}
+
 // buildVMparams returns a network.VirtualMachine struct with all needed fields included.
-func buildVMparams(vmName string, nicID, availSetID *string) compute.VirtualMachine {
+func buildVMparams(vmName string, nicID, availSetID *string, auth authConfig) (compute.VirtualMachine, error) {
+	osProfile, err := newOSProfile(vmName, auth)
+	if err != nil {
+		return compute.VirtualMachine{}, err
+	}
+
 	return compute.VirtualMachine{
-		Location: &westus,
+		Location: &location,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
-			OsProfile: &compute.OSProfile{
-				ComputerName:  &vmName,
-				AdminUsername: to.StringPtr("notAdmin"),
-				AdminPassword: to.StringPtr("Pa$$w0rd1975"),
-			},
+			OsProfile: osProfile,
 			HardwareProfile: &compute.HardwareProfile{
-				VMSize: compute.StandardDS1,
+				VMSize: compute.VirtualMachineSizeTypes(vmSize),
 			},
 			StorageProfile: &compute.StorageProfile{
 				ImageReference: &compute.ImageReference{
@@ -370,8 +711,8 @@ func buildVMparams(vmName string, nicID, availSetID *string) compute.VirtualMach
 					Name:         to.StringPtr("osDisk"),
 					Caching:      compute.None,
 					CreateOption: compute.FromImage,
-					Vhd: &compute.VirtualHardDisk{
-						URI: to.StringPtr(buildVhdURI(storageAccountName, vmName)),
+					ManagedDisk: &compute.ManagedDiskParameters{
+						StorageAccountType: compute.StandardLRS,
 					},
 				},
 			},
@@ -389,20 +730,67 @@ func buildVMparams(vmName string, nicID, availSetID *string) compute.VirtualMach
 				ID: availSetID,
 			},
 		},
+	}, nil
+}
+
+// nextAvailableLUN returns the first logical unit number (0-63) not already
+// used by a data disk attached to vm, or -1 if all 64 are taken.
+func nextAvailableLUN(vm compute.VirtualMachine) int32 {
+	used := make(map[int32]bool)
+	if vm.StorageProfile.DataDisks != nil {
+		for _, d := range *vm.StorageProfile.DataDisks {
+			used[*d.Lun] = true
+		}
+	}
+
+	for lun := int32(0); lun < 64; lun++ {
+		if !used[lun] {
+			return lun
+		}
 	}
+	return -1
 }
 
-// buildVhdURI returns the Vhd URI for a VM's OS disk.
-func buildVhdURI(storageAccountName, vmName string) string {
-	return fmt.Sprintf("https://%s.blob.core.windows.net/golangcontainer/%s.vhd",
-		storageAccountName,
-		vmName)
+// createDataDisk returns vm with an additional empty managed data disk of
+// sizeGiB attached at lun.
+func createDataDisk(vm compute.VirtualMachine, sizeGiB, lun int32) compute.VirtualMachine {
+	dataDisk := compute.DataDisk{
+		Lun:          to.Int32Ptr(lun),
+		DiskSizeGB:   to.Int32Ptr(sizeGiB),
+		Caching:      compute.ReadWrite,
+		CreateOption: compute.Empty,
+		ManagedDisk: &compute.ManagedDiskParameters{
+			StorageAccountType: compute.StandardLRS,
+		},
+	}
+
+	if vm.StorageProfile.DataDisks == nil {
+		vm.StorageProfile.DataDisks = &[]compute.DataDisk{dataDisk}
+	} else {
+		disks := append(*vm.StorageProfile.DataDisks, dataDisk)
+		vm.StorageProfile.DataDisks = &disks
+	}
+
+	return vm
 }
 
-// onErrorFail prints a failure message and exits the program if err is not nil.
+// onErrorFail prints a failure message and exits the program if err is not
+// nil. Since os.Exit never runs deferred functions, this is also where a
+// best-effort resource group cleanup runs for a Ctrl-C/SIGTERM interrupt
+// (which surfaces here as ctx.Err() from waitErr): if a resource group was
+// created and the run hasn't finished or been told to keep its resources,
+// it's deleted before the process exits.
 func onErrorFail(err error, message string) {
-	if err != nil {
-		fmt.Printf("%s: %s", message, err)
-		os.Exit(1)
+	if err == nil {
+		return
+	}
+	fmt.Printf("%s: %s", message, err)
+	if resourceGroupCreated && !finished && !keepOnFailure {
+		fmt.Println("Cleaning up the resource group created so far...")
+		_, errGroup := groupClient.Delete(groupName, nil)
+		if errDelete := waitErr(context.Background(), errGroup); errDelete != nil {
+			fmt.Printf("Delete resource group failed: %s", errDelete)
+		}
 	}
+	os.Exit(1)
 }